@@ -0,0 +1,204 @@
+// Package acl implements ghostunnel's certificate-based authorization
+// policy: an ordered set of rules matching a verified client certificate
+// by CN, OU, SAN DNS name, SAN URI (including spiffe://trust-domain/path
+// identities), serial number or fingerprint, each mapped to an
+// allow/deny decision.
+package acl
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Identity describes one way to match a verified client certificate.
+// A rule matches if any populated field matches the certificate.
+type Identity struct {
+	CN          string   `json:"cn,omitempty" yaml:"cn,omitempty"`
+	OU          []string `json:"ou,omitempty" yaml:"ou,omitempty"`
+	DNS         []string `json:"dns,omitempty" yaml:"dns,omitempty"`
+	URI         []string `json:"uri,omitempty" yaml:"uri,omitempty"`
+	Serial      string   `json:"serial,omitempty" yaml:"serial,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty" yaml:"fingerprint,omitempty"`
+}
+
+// Rule maps an Identity to an allow/deny decision, with an optional
+// per-identity rate limit (connections per second), enforced against
+// the matching rule's own token bucket by Policy.Verify.
+type Rule struct {
+	Identity  Identity `json:"identity" yaml:"identity"`
+	Allow     bool     `json:"allow" yaml:"allow"`
+	RateLimit int      `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+
+	limiterOnce sync.Once
+	limiter     *rateLimiter
+}
+
+// Policy is an ordered list of rules; the first matching rule decides
+// the outcome. A certificate that matches no rule is denied.
+type Policy struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// Load reads a policy file in YAML or JSON, selected by file extension.
+func Load(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("acl: unable to read policy file: %s", err)
+	}
+
+	var policy Policy
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, &policy)
+	} else {
+		err = yaml.Unmarshal(data, &policy)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("acl: unable to parse policy file: %s", err)
+	}
+
+	return &policy, nil
+}
+
+// Verify checks leaf against the policy's rules in order, enforcing the
+// matching rule's RateLimit (if any) once it would otherwise be allowed.
+func (p *Policy) Verify(leaf *x509.Certificate) error {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.Identity.matches(leaf) {
+			continue
+		}
+		if !rule.Allow {
+			return fmt.Errorf("acl: identity denied by policy")
+		}
+		if rule.RateLimit > 0 {
+			rule.limiterOnce.Do(func() {
+				rule.limiter = newRateLimiter(rule.RateLimit)
+			})
+			if !rule.limiter.allow() {
+				return fmt.Errorf("acl: rate limit of %d/s exceeded for matched identity", rule.RateLimit)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("acl: no policy rule matched certificate")
+}
+
+func (id Identity) matches(leaf *x509.Certificate) bool {
+	if id.CN != "" && id.CN == leaf.Subject.CommonName {
+		return true
+	}
+
+	for _, ou := range id.OU {
+		for _, certOU := range leaf.Subject.OrganizationalUnit {
+			if ou == certOU {
+				return true
+			}
+		}
+	}
+
+	for _, dns := range id.DNS {
+		for _, certDNS := range leaf.DNSNames {
+			if dns == certDNS {
+				return true
+			}
+		}
+	}
+
+	for _, uri := range id.URI {
+		for _, certURI := range leaf.URIs {
+			if uri == certURI.String() {
+				return true
+			}
+		}
+	}
+
+	if id.Serial != "" && id.Serial == leaf.SerialNumber.String() {
+		return true
+	}
+
+	if id.Fingerprint != "" {
+		sum := sha256.Sum256(leaf.Raw)
+		if id.Fingerprint == hex.EncodeToString(sum[:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rateLimiter is a simple token bucket, refilled at ratePerSecond tokens
+// per second up to a burst of ratePerSecond, used to enforce Rule.RateLimit.
+type rateLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	tokens   float64
+	capacity float64
+	last     time.Time
+}
+
+func newRateLimiter(ratePerSecond int) *rateLimiter {
+	rate := float64(ratePerSecond)
+	return &rateLimiter{rate: rate, tokens: rate, capacity: rate, last: time.Now()}
+}
+
+// allow reports whether a request may proceed, consuming one token if so.
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.capacity {
+		l.tokens = l.capacity
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Store holds the currently active Policy and allows it to be swapped
+// out atomically, so in-flight handshakes never observe a partially
+// loaded policy while a SIGHUP reload is in progress.
+type Store struct {
+	path    string
+	current atomic.Value
+}
+
+// NewStore loads the policy at path and returns a Store wrapping it.
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the policy file and swaps it in atomically. On error
+// the previously loaded policy remains active.
+func (s *Store) Reload() error {
+	policy, err := Load(s.path)
+	if err != nil {
+		return err
+	}
+	s.current.Store(policy)
+	return nil
+}
+
+// Verify checks leaf against the currently active policy.
+func (s *Store) Verify(leaf *x509.Certificate) error {
+	return s.current.Load().(*Policy).Verify(leaf)
+}
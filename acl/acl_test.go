@@ -0,0 +1,140 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net/url"
+	"testing"
+)
+
+func testLeaf() *x509.Certificate {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "client.example.com",
+			OrganizationalUnit: []string{"engineering"},
+		},
+		DNSNames:     []string{"client.internal"},
+		SerialNumber: big.NewInt(12345),
+		Raw:          []byte("fake certificate bytes"),
+	}
+	uri, _ := url.Parse("spiffe://example.com/ns/default/sa/client")
+	cert.URIs = []*url.URL{uri}
+	return cert
+}
+
+func TestIdentityMatchesCN(t *testing.T) {
+	id := Identity{CN: "client.example.com"}
+	if !id.matches(testLeaf()) {
+		t.Error("expected CN match")
+	}
+}
+
+func TestIdentityMatchesOU(t *testing.T) {
+	id := Identity{OU: []string{"other", "engineering"}}
+	if !id.matches(testLeaf()) {
+		t.Error("expected OU match")
+	}
+}
+
+func TestIdentityMatchesDNS(t *testing.T) {
+	id := Identity{DNS: []string{"client.internal"}}
+	if !id.matches(testLeaf()) {
+		t.Error("expected DNS match")
+	}
+}
+
+func TestIdentityMatchesURI(t *testing.T) {
+	id := Identity{URI: []string{"spiffe://example.com/ns/default/sa/client"}}
+	if !id.matches(testLeaf()) {
+		t.Error("expected SPIFFE URI match")
+	}
+}
+
+func TestIdentityMatchesSerial(t *testing.T) {
+	id := Identity{Serial: "12345"}
+	if !id.matches(testLeaf()) {
+		t.Error("expected serial match")
+	}
+}
+
+func TestIdentityMatchesFingerprint(t *testing.T) {
+	sum := sha256.Sum256(testLeaf().Raw)
+	id := Identity{Fingerprint: hex.EncodeToString(sum[:])}
+	if !id.matches(testLeaf()) {
+		t.Error("expected fingerprint match")
+	}
+}
+
+func TestIdentityNoMatch(t *testing.T) {
+	id := Identity{CN: "someone-else.example.com"}
+	if id.matches(testLeaf()) {
+		t.Error("expected no match")
+	}
+}
+
+func TestPolicyVerifyFirstMatchWins(t *testing.T) {
+	policy := &Policy{
+		Rules: []Rule{
+			{Identity: Identity{CN: "client.example.com"}, Allow: false},
+			{Identity: Identity{OU: []string{"engineering"}}, Allow: true},
+		},
+	}
+
+	if err := policy.Verify(testLeaf()); err == nil {
+		t.Fatal("expected deny from first matching rule, got nil error")
+	}
+}
+
+func TestPolicyVerifyAllow(t *testing.T) {
+	policy := &Policy{
+		Rules: []Rule{
+			{Identity: Identity{CN: "client.example.com"}, Allow: true},
+		},
+	}
+
+	if err := policy.Verify(testLeaf()); err != nil {
+		t.Fatalf("expected allow, got error: %s", err)
+	}
+}
+
+func TestPolicyVerifyNoRuleMatches(t *testing.T) {
+	policy := &Policy{
+		Rules: []Rule{
+			{Identity: Identity{CN: "someone-else.example.com"}, Allow: true},
+		},
+	}
+
+	if err := policy.Verify(testLeaf()); err == nil {
+		t.Fatal("expected deny when no rule matches, got nil error")
+	}
+}
+
+func TestPolicyVerifyRateLimit(t *testing.T) {
+	policy := &Policy{
+		Rules: []Rule{
+			{Identity: Identity{CN: "client.example.com"}, Allow: true, RateLimit: 1},
+		},
+	}
+
+	if err := policy.Verify(testLeaf()); err != nil {
+		t.Fatalf("expected first request to be allowed, got error: %s", err)
+	}
+	if err := policy.Verify(testLeaf()); err == nil {
+		t.Fatal("expected second immediate request to be rate limited, got nil error")
+	}
+}
+
+func TestRateLimiterAllowsUpToBurst(t *testing.T) {
+	l := newRateLimiter(3)
+	for i := 0; i < 3; i++ {
+		if !l.allow() {
+			t.Fatalf("expected request %d to be allowed within burst", i)
+		}
+	}
+	if l.allow() {
+		t.Fatal("expected request beyond burst to be denied")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/square/ghostunnel/logging"
+	"github.com/square/ghostunnel/metrics"
+)
+
+// runClient implements --mode=reverse: accept plaintext TCP connections
+// on --listen and forward each one over a verified mTLS connection to
+// --target, presenting our client certificate and validating the remote
+// server against --cacert/--server-name/--verify-cn. This is the
+// counterpart to runServer's mTLS termination, mirroring stunnel's
+// client mode, and shares the same drain/reload/metrics plumbing.
+func runClient() {
+	network, address := decodeAddress(*listenAddress)
+	listener, err := newListener(network, address)
+	panicOnError(err)
+
+	logger.Printf("listening on %s (reverse mode, forwarding to %s over mTLS)", *listenAddress, *forwardAddress)
+
+	clientConfig := buildClientConfig()
+
+	// Waits for both the accept loop and the SIGTERM drain to finish.
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+
+	// A channel to allow signal handlers to notify our main accept loop
+	// that it must shut down.
+	stopper := make(chan bool, 1)
+
+	// Tracks connections currently being proxied, so SIGTERM can drain
+	// them gracefully instead of exiting out from underneath them.
+	conns := newConnTracker()
+
+	// Closed once the accept loop has started calling Accept() on the
+	// listener, so a reloading child only signals its parent after it
+	// is verifiably ready to take over.
+	acceptReady := make(chan struct{})
+
+	go acceptReverse(listener, wg, stopper, conns, acceptReady, clientConfig)
+	go func() {
+		defer wg.Done()
+		sigtermHandler(listener, stopper, conns, *shutdownTimeout)
+	}()
+	go sigusr1Handler(conns)
+
+	if *metricsListen != "" {
+		go func() {
+			logger.Printf("serving metrics on %s", *metricsListen)
+			if err := metrics.Serve(*metricsListen); err != nil {
+				logger.Printf("metrics server exited: %s", err)
+			}
+		}()
+	}
+
+	// Are we a worker spawned by a supervising parent? Signal readiness
+	// back to it, but only once our accept loop is actually running.
+	if *gracefulChild {
+		<-acceptReady
+		signalGracefulReady()
+	}
+
+	logger.Printf("startup completed, waiting for connections")
+
+	wg.Wait()
+
+	logger.Printf("all connections closed, shutting down")
+}
+
+// acceptReverse runs the main accept loop for reverse mode, dispatching
+// each incoming plaintext connection to dial() in its own goroutine. It
+// mirrors server.go's accept(), so reverse mode drains on SIGTERM and
+// signals readiness to a supervising parent the same way server mode does.
+func acceptReverse(listener net.Listener, wg *sync.WaitGroup, stopper chan bool, conns *connTracker, ready chan struct{}, clientConfig *tls.Config) {
+	defer wg.Done()
+	close(ready)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-stopper:
+				return
+			default:
+				logger.Printf("error accepting connection: %s", err)
+				continue
+			}
+		}
+
+		metrics.ConnectionsAccepted.Inc()
+		go dial(conn, conns, clientConfig)
+	}
+}
+
+// dial proxies a single plaintext connection to the remote mTLS target,
+// tracked in conns for the duration of the proxy so a graceful shutdown
+// can drain or force-close it like the server path does. Bytes and a
+// structured connection log entry are recorded the same way handle()
+// does for the server path.
+func dial(conn net.Conn, conns *connTracker, clientConfig *tls.Config) {
+	conns.add(conn)
+	metrics.OpenConnections.Inc()
+	defer func() {
+		conns.remove(conn)
+		metrics.OpenConnections.Dec()
+	}()
+	defer conn.Close()
+
+	started := time.Now()
+	fields := logging.ConnectionFields{}
+
+	network, address := decodeAddress(*forwardAddress)
+	backend, err := tls.Dial(network, address, clientConfig)
+	if err != nil {
+		logger.Printf("error dialing backend over mTLS: %s", err)
+		return
+	}
+	defer backend.Close()
+
+	state := backend.ConnectionState()
+	fields.SNI = state.ServerName
+	fields.Cipher = tls.CipherSuiteName(state.CipherSuite)
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		fields.Serial = leaf.SerialNumber.String()
+		fields.Subject = leaf.Subject.String()
+	}
+
+	// Close both ends as soon as either direction finishes, so a peer
+	// that closes its side doesn't leave the other copy blocked forever
+	// reading from a connection that will never send anything else.
+	done := make(chan struct{}, 2)
+	go func() {
+		n, _ := io.Copy(backend, conn)
+		fields.BytesIn += n
+		conn.Close()
+		backend.Close()
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := io.Copy(conn, backend)
+		fields.BytesOut += n
+		conn.Close()
+		backend.Close()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	fields.Duration = time.Since(started)
+	metrics.BytesTransferred.WithLabelValues("in").Add(float64(fields.BytesIn))
+	metrics.BytesTransferred.WithLabelValues("out").Add(float64(fields.BytesOut))
+	logger.Connection(fields)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/square/ghostunnel/logging"
+	"github.com/square/ghostunnel/metrics"
+)
+
+// handle proxies a single accepted connection to the forward address,
+// instrumenting it with Prometheus metrics and a structured connection
+// log entry once it finishes. The connection is registered with conns
+// for the duration of the proxy so that a graceful shutdown can track
+// and, if needed, force-close it.
+func handle(conn net.Conn, conns *connTracker) {
+	conns.add(conn)
+	metrics.OpenConnections.Inc()
+	defer func() {
+		conns.remove(conn)
+		metrics.OpenConnections.Dec()
+	}()
+	defer conn.Close()
+
+	started := time.Now()
+	fields := logging.ConnectionFields{}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		handshakeStart := time.Now()
+		if err := tlsConn.Handshake(); err != nil {
+			metrics.HandshakeFailures.WithLabelValues(handshakeFailureReason(err)).Inc()
+			logger.Printf("TLS handshake failed: %s", err)
+			return
+		}
+		metrics.HandshakeLatency.Observe(time.Since(handshakeStart).Seconds())
+
+		state := tlsConn.ConnectionState()
+		fields.SNI = state.ServerName
+		fields.Cipher = tls.CipherSuiteName(state.CipherSuite)
+		if len(state.PeerCertificates) > 0 {
+			leaf := state.PeerCertificates[0]
+			fields.Serial = leaf.SerialNumber.String()
+			fields.Subject = leaf.Subject.String()
+			if len(leaf.Subject.OrganizationalUnit) > 0 {
+				fields.OU = leaf.Subject.OrganizationalUnit[0]
+			}
+		}
+	}
+
+	backend, err := net.Dial(decodeAddress(*forwardAddress))
+	if err != nil {
+		logger.Printf("error connecting to backend: %s", err)
+		return
+	}
+	defer backend.Close()
+
+	if *proxyProtocol != "" {
+		if err := writeProxyProtocolHeader(backend, conn); err != nil {
+			logger.Printf("error writing PROXY protocol header: %s", err)
+			return
+		}
+	}
+
+	// Close both ends as soon as either direction finishes, so a peer
+	// that closes its side doesn't leave the other copy blocked forever
+	// reading from a connection that will never send anything else.
+	done := make(chan struct{}, 2)
+	go func() {
+		n, _ := io.Copy(backend, conn)
+		fields.BytesIn += n
+		conn.Close()
+		backend.Close()
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := io.Copy(conn, backend)
+		fields.BytesOut += n
+		conn.Close()
+		backend.Close()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	fields.Duration = time.Since(started)
+	metrics.BytesTransferred.WithLabelValues("in").Add(float64(fields.BytesIn))
+	metrics.BytesTransferred.WithLabelValues("out").Add(float64(fields.BytesOut))
+	logger.Connection(fields)
+}
+
+// handshakeFailureReason classifies a TLS handshake error into one of
+// the reasons tracked by the ghostunnel_handshake_failures_total metric.
+func handshakeFailureReason(err error) string {
+	// crypto/tls wraps chain verification errors; classify the x509 cause.
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &verifyErr) {
+		err = verifyErr.Err
+	}
+
+	switch e := err.(type) {
+	case x509.CertificateInvalidError:
+		if e.Reason == x509.Expired {
+			return metrics.ReasonExpired
+		}
+		return metrics.ReasonOther
+	case x509.UnknownAuthorityError:
+		return metrics.ReasonUnknownCA
+	default:
+		if strings.Contains(err.Error(), "OU does not match") {
+			return metrics.ReasonBadOU
+		}
+		return metrics.ReasonOther
+	}
+}
@@ -0,0 +1,66 @@
+// Package logging provides the pluggable logger used throughout
+// ghostunnel, so that plain text, JSON and syslog output all go through
+// the same per-connection structured logging path.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Logger is implemented by each supported output format. Printf carries
+// the existing free-form operational log lines; Connection emits a
+// structured record describing one finished proxied connection.
+type Logger interface {
+	Printf(format string, args ...interface{})
+	Connection(fields ConnectionFields)
+}
+
+// ConnectionFields describes a single proxied connection for structured
+// logging, populated once the connection has finished.
+type ConnectionFields struct {
+	Serial      string        `json:"serial"`
+	Subject     string        `json:"subject"`
+	OU          string        `json:"ou"`
+	SNI         string        `json:"sni"`
+	Cipher      string        `json:"cipher"`
+	Duration    time.Duration `json:"duration"`
+	BytesIn     int64         `json:"bytes_in"`
+	BytesOut    int64         `json:"bytes_out"`
+}
+
+// New returns a Logger that writes to out in the given format ("text" or
+// "json"), prefixed the same way the rest of ghostunnel's log lines are.
+func New(format string, out io.Writer, prefix string) Logger {
+	base := log.New(out, prefix, log.LstdFlags|log.Lmicroseconds)
+
+	if format == "json" {
+		return &jsonLogger{base}
+	}
+	return &textLogger{base}
+}
+
+type textLogger struct {
+	*log.Logger
+}
+
+func (t *textLogger) Connection(f ConnectionFields) {
+	t.Printf("conn serial=%s subject=%q ou=%s sni=%s cipher=%s duration=%s bytes_in=%d bytes_out=%d",
+		f.Serial, f.Subject, f.OU, f.SNI, f.Cipher, f.Duration, f.BytesIn, f.BytesOut)
+}
+
+type jsonLogger struct {
+	*log.Logger
+}
+
+func (j *jsonLogger) Connection(f ConnectionFields) {
+	b, err := json.Marshal(f)
+	if err != nil {
+		j.Printf("error marshaling connection log: %s", err)
+		return
+	}
+	j.Output(2, fmt.Sprintf("%s", b))
+}
@@ -1,16 +1,15 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
-	"log"
+	"io"
 	"log/syslog"
 	"os"
 	"runtime"
-	"sync"
-	"syscall"
 
-	"github.com/kavu/go_reuseport"
+	"github.com/square/ghostunnel/acl"
+	"github.com/square/ghostunnel/logging"
+	"github.com/square/ghostunnel/supervisor"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -18,30 +17,61 @@ var (
 	// Startup flags
 	listenAddress  = kingpin.Flag("listen", "Address and port to listen on").Required().TCP()
 	forwardAddress = kingpin.Flag("target", "Address to foward connections to").Required().TCP()
-	clientNames    = kingpin.Flag("client", "Expected client organizational unit name (can be repeated)").Required().Strings()
+	clientNames    = kingpin.Flag("client", "Expected client organizational unit name (can be repeated)").Strings()
 	privateKeyPath = kingpin.Flag("key", "Path to private key file (PEM/PKCS1)").Required().String()
 	certChainPath  = kingpin.Flag("cert", "Path to certificate chain file (PEM/X509)").Required().String()
 	caBundlePath   = kingpin.Flag("cacert", "Path to certificate authority bundle file (PEM/X509)").Required().String()
 	useSyslog      = kingpin.Flag("syslog", "Send logs to syslog instead of stderr").Bool()
 
+	// Mode flags
+	mode       = kingpin.Flag("mode", "Operating mode: server (terminate mTLS, forward plaintext) or reverse (accept plaintext, dial out via mTLS)").Default("server").Enum("server", "reverse")
+	serverName = kingpin.Flag("server-name", "Expected SNI/server name to send when dialing out in reverse mode").String()
+	verifyCN   = kingpin.Flag("verify-cn", "Expected CN on the remote server certificate in reverse mode").String()
+
 	// Internal flags for reload
-	gracefulChild = kingpin.Flag("graceful", "Send SIGTERM to parent after startup (internal)").Bool()
+	gracefulChild = kingpin.Flag("graceful", "Signal readiness to a supervising parent after startup (internal)").Bool()
+	listenFD      = kingpin.Flag("listen-fd", "File descriptor number of an inherited listening socket (internal, set by supervisor-spawned workers)").Default("-1").Int()
+
+	// Supervisor/wrapper mode flags
+	wrapperMode = kingpin.Flag("wrapper", "Run as a supervisor that launches and monitors a worker process, handling reloads and rollback").Bool()
+	pidFile     = kingpin.Flag("pid-file", "Path to write the supervisor PID file (wrapper mode only)").String()
+	managerSock = kingpin.Flag("management-socket", "Path to UNIX socket for supervisor management commands (wrapper mode only)").String()
+
+	// Shutdown flags
+	shutdownTimeout = kingpin.Flag("shutdown-timeout", "How long to wait for open connections to close on SIGTERM before forcing them closed").Default("10s").Duration()
+
+	// Forwarding flags
+	proxyProtocol = kingpin.Flag("proxy-protocol", "Prepend a PROXY protocol header (v1 or v2) when dialing the backend").Enum("v1", "v2")
+
+	// Observability flags
+	metricsListen = kingpin.Flag("metrics-listen", "Address to expose Prometheus metrics on, e.g. localhost:9100").String()
+	logFormat     = kingpin.Flag("log-format", "Log format to use for connection logs").Default("text").Enum("text", "json")
+
+	// ACL flags
+	aclFile = kingpin.Flag("acl-file", "Path to a YAML/JSON policy file for client authorization (overrides --client OU matching); reloaded on SIGHUP").String()
 )
 
-// Global logger instance
-var logger *log.Logger
+// Global logger instance, routed through the pluggable logging package so
+// syslog/json/text output all go through the same structured path.
+var logger logging.Logger
+
+// aclStore holds the --acl-file policy, if configured. It is reloaded on
+// SIGHUP independently of the full SO_REUSEPORT reexec, so operators can
+// push an authorization change without a restart.
+var aclStore *acl.Store
 
 func initLogger() {
+	var out io.Writer
 	if *useSyslog {
-		var err error
-		logger, err = syslog.NewLogger(syslog.LOG_NOTICE|syslog.LOG_DAEMON, log.LstdFlags|log.Lmicroseconds)
+		writer, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_DAEMON, "ghostunnel")
 		panicOnError(err)
+		out = writer
 	} else {
-		logger = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
+		out = os.Stderr
 	}
 
-	// Set log prefix to process ID to distinguish parent/child
-	logger.SetPrefix(fmt.Sprintf("[%5d] ", os.Getpid()))
+	// Use process ID as log prefix to distinguish parent/child
+	logger = logging.New(*logFormat, out, fmt.Sprintf("[%5d] ", os.Getpid()))
 }
 
 // panicOnError panics if err is not nil
@@ -56,42 +86,30 @@ func main() {
 	kingpin.Parse()
 	initLogger()
 
-	// Open listening socket. Take note that we create a "reusable port
-	// listener", meaning we pass SO_REUSEPORT to the kernel. This allows
-	// us to have multiple processes listening on the same port and accept
-	// connections. This is useful for the purposes of replacing certificates
-	// in-place without having to take downtime, e.g. if a certificate is
-	// expiring. See also reexec().
-	network, address := decodeAddress(*listenAddress)
-	rawListener, err := reuseport.NewReusablePortListener(network, address)
-	panicOnError(err)
-
-	// Wrap listening socket with TLS listener.
-	listener := tls.NewListener(rawListener, buildConfig())
-	logger.Printf("listening on %s", *listenAddress)
-
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	// A channel to allow signal handlers to notify our main accept loop
-	// that it must shut down.
-	stopper := make(chan bool, 1)
-
-	go accept(listener, wg, stopper)
-	go sigtermHandler(listener, stopper)
-	go sigusr1Handler()
-
-	// Are we a child process spawned by a reloading parent? Send SIGTERM to
-	// parent to indicate successful startup.
-	if *gracefulChild {
-		parent := syscall.Getppid()
-		logger.Printf("sending SIGTERM to parent PID %d", parent)
-		syscall.Kill(parent, syscall.SIGTERM)
+	// In wrapper mode we don't serve connections ourselves -- instead we
+	// open the listening socket, fork and monitor a worker process
+	// (re-exec of ourselves without --wrapper) that accepts on it, and on
+	// reload only cut over to a new worker once it has signalled that it
+	// is accepting. See the supervisor package for the rollback logic.
+	if *wrapperMode {
+		network, address := decodeAddress(*listenAddress)
+		sup, err := supervisor.New(supervisor.Config{
+			Args:             os.Args[1:],
+			PidFile:          *pidFile,
+			ManagementSocket: *managerSock,
+			ListenNetwork:    network,
+			ListenAddress:    address,
+			Logger:           logger,
+		})
+		panicOnError(err)
+		panicOnError(sup.Run())
+		return
 	}
 
-	logger.Printf("startup completed, waiting for connections")
-
-	wg.Wait()
-
-	logger.Printf("all connections closed, shutting down")
+	switch *mode {
+	case "reverse":
+		runClient()
+	default:
+		runServer()
+	}
 }
@@ -0,0 +1,72 @@
+// Package metrics holds the Prometheus collectors ghostunnel exposes via
+// --metrics-listen, and the handshake failure reasons used to label them.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Handshake failure reasons used as the "reason" label on
+// HandshakeFailures. Kept as constants so call sites can't typo a label
+// value that silently creates a new series.
+const (
+	ReasonExpired   = "expired"
+	ReasonUnknownCA = "unknown_ca"
+	ReasonBadOU     = "bad_ou"
+	ReasonOther     = "other"
+)
+
+var (
+	ConnectionsAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ghostunnel_connections_accepted_total",
+		Help: "Total number of connections accepted.",
+	})
+
+	HandshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ghostunnel_handshake_failures_total",
+		Help: "Total number of TLS handshake failures, by reason.",
+	}, []string{"reason"})
+
+	OpenConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ghostunnel_open_connections",
+		Help: "Number of currently open proxied connections.",
+	})
+
+	BytesTransferred = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ghostunnel_bytes_transferred_total",
+		Help: "Total bytes copied between client and backend, by direction.",
+	}, []string{"direction"})
+
+	HandshakeLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ghostunnel_handshake_latency_seconds",
+		Help:    "Time spent performing the TLS handshake.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	ReloadEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ghostunnel_reload_events_total",
+		Help: "Total number of certificate/config reloads.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		ConnectionsAccepted,
+		HandshakeFailures,
+		OpenConnections,
+		BytesTransferred,
+		HandshakeLatency,
+		ReloadEvents,
+	)
+}
+
+// Serve starts an HTTP server exposing the registered collectors on
+// /metrics at addr. It blocks until the server exits.
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,146 @@
+// Package proxyproto implements just enough of the HAProxy PROXY
+// protocol (v1 text and v2 binary) to let ghostunnel tell a backend the
+// real client address and mTLS identity, instead of the backend seeing
+// only the proxy's own loopback connection.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Version selects which PROXY protocol wire format to emit.
+type Version string
+
+const (
+	V1 Version = "v1"
+	V2 Version = "v2"
+)
+
+// v2Signature is the fixed 12-byte magic that starts every v2 header.
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// TLV subtypes used in the v2 PP2_TYPE_SSL TLV, plus our own custom
+// subtype carrying the matched client OU.
+const (
+	pp2TypeSSL        = 0x20
+	pp2SubtypeSSLCN   = 0x22
+	pp2SubtypeSSLOU   = 0xE0 // custom/experimental range
+	pp2ClientCertFlag = 0x03 // PP2_CLIENT_SSL | PP2_CLIENT_CERT_CONN
+)
+
+// Header describes the information ghostunnel has about the original
+// client connection and its verified mTLS identity.
+type Header struct {
+	SourceAddr net.Addr
+	DestAddr   net.Addr
+	CommonName string
+	OU         string
+}
+
+// Write encodes and writes the PROXY protocol header described by h to
+// w, ahead of the proxied payload.
+func Write(w interface{ Write([]byte) (int, error) }, version Version, h Header) error {
+	var buf []byte
+	var err error
+
+	switch version {
+	case V1:
+		buf, err = encodeV1(h)
+	case V2:
+		buf, err = encodeV2(h)
+	default:
+		return fmt.Errorf("proxyproto: unknown version %q", version)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// encodeV1 builds the human-readable text header, e.g.
+// "PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n"
+func encodeV1(h Header) ([]byte, error) {
+	srcTCP, ok := h.SourceAddr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("proxyproto: v1 requires a TCP source address")
+	}
+	dstTCP, ok := h.DestAddr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("proxyproto: v1 requires a TCP destination address")
+	}
+
+	family := "TCP4"
+	if srcTCP.IP.To4() == nil {
+		family = "TCP6"
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		family, srcTCP.IP.String(), dstTCP.IP.String(), srcTCP.Port, dstTCP.Port)), nil
+}
+
+// encodeV2 builds the binary v2 header, including an SSL TLV carrying
+// the verified client certificate's CN and OU.
+func encodeV2(h Header) ([]byte, error) {
+	srcTCP, ok := h.SourceAddr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("proxyproto: v2 requires a TCP source address")
+	}
+	dstTCP, ok := h.DestAddr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("proxyproto: v2 requires a TCP destination address")
+	}
+
+	addrFamily := byte(0x11) // AF_INET, stream
+	if srcTCP.IP.To4() == nil {
+		addrFamily = 0x21 // AF_INET6, stream
+	}
+
+	var addrBytes bytes.Buffer
+	if addrFamily == 0x11 {
+		addrBytes.Write(srcTCP.IP.To4())
+		addrBytes.Write(dstTCP.IP.To4())
+	} else {
+		addrBytes.Write(srcTCP.IP.To16())
+		addrBytes.Write(dstTCP.IP.To16())
+	}
+	binary.Write(&addrBytes, binary.BigEndian, uint16(srcTCP.Port))
+	binary.Write(&addrBytes, binary.BigEndian, uint16(dstTCP.Port))
+
+	tlvs := encodeSSLTLV(h)
+
+	var out bytes.Buffer
+	out.Write(v2Signature)
+	out.WriteByte(0x21) // version 2, PROXY command
+	out.WriteByte(addrFamily)
+	binary.Write(&out, binary.BigEndian, uint16(addrBytes.Len()+tlvs.Len()))
+	out.Write(addrBytes.Bytes())
+	out.Write(tlvs.Bytes())
+
+	return out.Bytes(), nil
+}
+
+// encodeSSLTLV builds the PP2_TYPE_SSL TLV with nested CN and OU TLVs
+// describing the verified client certificate.
+func encodeSSLTLV(h Header) *bytes.Buffer {
+	var sub bytes.Buffer
+	sub.WriteByte(pp2ClientCertFlag)
+	sub.Write([]byte{0, 0, 0, 0}) // verify result: 0 == success
+
+	writeTLV(&sub, pp2SubtypeSSLCN, []byte(h.CommonName))
+	writeTLV(&sub, pp2SubtypeSSLOU, []byte(h.OU))
+
+	var out bytes.Buffer
+	writeTLV(&out, pp2TypeSSL, sub.Bytes())
+	return &out
+}
+
+func writeTLV(buf *bytes.Buffer, typ byte, value []byte) {
+	buf.WriteByte(typ)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+}
@@ -0,0 +1,115 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func testHeader() Header {
+	return Header{
+		SourceAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51000},
+		DestAddr:   &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443},
+		CommonName: "client.example.com",
+		OU:         "engineering",
+	}
+}
+
+func TestWriteV1(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, V1, testHeader()); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	want := "PROXY TCP4 10.0.0.1 10.0.0.2 51000 443\r\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestWriteV1IPv6(t *testing.T) {
+	h := Header{
+		SourceAddr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1},
+		DestAddr:   &net.TCPAddr{IP: net.ParseIP("::2"), Port: 2},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, V1, h); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	if !bytes.HasPrefix(buf.Bytes(), []byte("PROXY TCP6 ")) {
+		t.Errorf("expected TCP6 family, got %q", buf.String())
+	}
+}
+
+func TestWriteV1RequiresTCPAddr(t *testing.T) {
+	h := Header{
+		SourceAddr: &net.UnixAddr{Name: "/tmp/foo"},
+		DestAddr:   &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443},
+	}
+
+	if err := Write(&bytes.Buffer{}, V1, h); err == nil {
+		t.Fatal("expected error for non-TCP source address, got nil")
+	}
+}
+
+func TestWriteV2Signature(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, V2, testHeader()); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	got := buf.Bytes()
+	if !bytes.Equal(got[:len(v2Signature)], v2Signature) {
+		t.Fatalf("header does not start with v2 signature: %x", got[:len(v2Signature)])
+	}
+	if got[len(v2Signature)] != 0x21 {
+		t.Errorf("expected version/command byte 0x21, got %#x", got[len(v2Signature)])
+	}
+}
+
+func TestWriteV2LengthMatchesBody(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, V2, testHeader()); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	got := buf.Bytes()
+	headerLen := 16 // signature(12) + ver/cmd(1) + family(1) + length(2)
+	declaredLen := int(got[14])<<8 | int(got[15])
+	if len(got)-headerLen != declaredLen {
+		t.Errorf("declared TLV+address length %d does not match actual body length %d", declaredLen, len(got)-headerLen)
+	}
+}
+
+func TestWriteV2CarriesCNAndOU(t *testing.T) {
+	h := testHeader()
+	var buf bytes.Buffer
+	if err := Write(&buf, V2, h); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	if !bytes.Contains(buf.Bytes(), []byte(h.CommonName)) {
+		t.Error("encoded header does not contain the common name")
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(h.OU)) {
+		t.Error("encoded header does not contain the OU")
+	}
+}
+
+func TestWriteUnknownVersion(t *testing.T) {
+	if err := Write(&bytes.Buffer{}, Version("v3"), testHeader()); err == nil {
+		t.Fatal("expected error for unknown version, got nil")
+	}
+}
+
+func TestWriteTLV(t *testing.T) {
+	var buf bytes.Buffer
+	writeTLV(&buf, 0x21, []byte("hello"))
+
+	want := append([]byte{0x21, 0x00, 0x05}, []byte("hello")...)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("got %x, want %x", buf.Bytes(), want)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kavu/go_reuseport"
+	"github.com/square/ghostunnel/acl"
+	"github.com/square/ghostunnel/metrics"
+	"github.com/square/ghostunnel/proxyproto"
+)
+
+// runServer implements the default (--mode=server) operation: terminate
+// mTLS connections from clients and forward the plaintext payload to
+// --target, with graceful draining, reload, ACL and metrics support.
+func runServer() {
+	if *aclFile == "" && len(*clientNames) == 0 {
+		panic("at least one of --client or --acl-file must be set to authorize client certificates")
+	}
+
+	if *aclFile != "" {
+		var err error
+		aclStore, err = acl.NewStore(*aclFile)
+		panicOnError(err)
+		go aclReloadHandler(aclStore)
+	}
+
+	// Open listening socket: either inherited from a supervising parent
+	// (wrapper mode) or, ordinarily, a "reusable port listener" meaning we
+	// pass SO_REUSEPORT to the kernel. SO_REUSEPORT allows us to have
+	// multiple processes listening on the same port and accept
+	// connections. This is useful for the purposes of replacing certificates
+	// in-place without having to take downtime, e.g. if a certificate is
+	// expiring.
+	network, address := decodeAddress(*listenAddress)
+	rawListener, err := newListener(network, address)
+	panicOnError(err)
+
+	// Wrap listening socket with TLS listener.
+	listener := tls.NewListener(rawListener, buildServerConfig())
+	logger.Printf("listening on %s", *listenAddress)
+
+	// Waits for both the accept loop and the SIGTERM drain to finish.
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+
+	// A channel to allow signal handlers to notify our main accept loop
+	// that it must shut down.
+	stopper := make(chan bool, 1)
+
+	// Tracks connections currently being proxied, so SIGTERM can drain
+	// them gracefully instead of exiting out from underneath them.
+	conns := newConnTracker()
+
+	// Closed once the accept loop has started calling Accept() on the
+	// listener, so a reloading child only signals its parent after it
+	// is verifiably ready to take over.
+	acceptReady := make(chan struct{})
+
+	go accept(listener, wg, stopper, conns, acceptReady)
+	go func() {
+		defer wg.Done()
+		sigtermHandler(listener, stopper, conns, *shutdownTimeout)
+	}()
+	go sigusr1Handler(conns)
+
+	if *metricsListen != "" {
+		go func() {
+			logger.Printf("serving metrics on %s", *metricsListen)
+			if err := metrics.Serve(*metricsListen); err != nil {
+				logger.Printf("metrics server exited: %s", err)
+			}
+		}()
+	}
+
+	// Are we a worker spawned by a supervising parent? Signal readiness
+	// back to it, but only once our accept loop is actually running.
+	if *gracefulChild {
+		<-acceptReady
+		signalGracefulReady()
+	}
+
+	logger.Printf("startup completed, waiting for connections")
+
+	wg.Wait()
+
+	logger.Printf("all connections closed, shutting down")
+}
+
+// decodeAddress splits a *net.TCPAddr from a kingpin flag into the
+// network/address pair expected by go_reuseport.
+func decodeAddress(addr *net.TCPAddr) (network, address string) {
+	network = "tcp4"
+	if addr.IP != nil && addr.IP.To4() == nil {
+		network = "tcp6"
+	}
+	return network, addr.String()
+}
+
+// newListener opens the listening socket for network/address. Under a
+// supervisor (wrapper mode), --listen-fd is set and we wrap the
+// already-open listening socket passed down via fd inheritance instead
+// of binding a new one (see supervisor.spawn). Otherwise we bind with
+// SO_REUSEPORT so multiple processes can accept on the same address
+// during a reload.
+func newListener(network, address string) (net.Listener, error) {
+	if *listenFD >= 0 {
+		f := os.NewFile(uintptr(*listenFD), "inherited-listener")
+		ln, err := net.FileListener(f)
+		f.Close()
+		return ln, err
+	}
+	return reuseport.NewReusablePortListener(network, address)
+}
+
+// gracefulReadyFD is the file descriptor a supervisor-spawned worker
+// writes to once its accept loop is confirmed running, to signal
+// readiness to the supervisor without colliding with SIGTERM (which the
+// worker itself, and the supervisor's own shutdown handling, both
+// already use). Must match supervisor.childReadyFD.
+const gracefulReadyFD = 3
+
+// signalGracefulReady tells a supervising parent that this worker's
+// accept loop is up, by writing to the inherited readiness pipe rather
+// than sending it a signal.
+func signalGracefulReady() {
+	f := os.NewFile(gracefulReadyFD, "graceful-ready")
+	if f == nil {
+		logger.Printf("--graceful set but no readiness pipe inherited on fd %d", gracefulReadyFD)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		logger.Printf("error signalling readiness to supervisor: %s", err)
+	}
+}
+
+// connTracker keeps track of the set of connections currently being
+// proxied, so that a SIGTERM drain can wait for them to finish naturally
+// and, if the deadline passes, force-close whatever is left.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]struct{})}
+}
+
+func (t *connTracker) add(conn net.Conn) {
+	t.mu.Lock()
+	t.conns[conn] = struct{}{}
+	t.mu.Unlock()
+}
+
+func (t *connTracker) remove(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+}
+
+func (t *connTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// closeAll force-closes every tracked connection, e.g. once the shutdown
+// deadline has passed.
+func (t *connTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// accept runs the main accept loop, dispatching each incoming connection
+// to handle() in its own goroutine. It returns once the listener is closed.
+func accept(listener net.Listener, wg *sync.WaitGroup, stopper chan bool, conns *connTracker, ready chan struct{}) {
+	defer wg.Done()
+	close(ready)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-stopper:
+				return
+			default:
+				logger.Printf("error accepting connection: %s", err)
+				continue
+			}
+		}
+
+		metrics.ConnectionsAccepted.Inc()
+		go handle(conn, conns)
+	}
+}
+
+// writeProxyProtocolHeader builds and writes a PROXY protocol header to
+// backend describing the original client connection and, for a TLS
+// conn, its verified certificate CN/OU.
+func writeProxyProtocolHeader(backend net.Conn, conn net.Conn) error {
+	header := proxyproto.Header{
+		SourceAddr: conn.RemoteAddr(),
+		DestAddr:   conn.LocalAddr(),
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		if len(state.PeerCertificates) > 0 {
+			leaf := state.PeerCertificates[0]
+			header.CommonName = leaf.Subject.CommonName
+			if len(leaf.Subject.OrganizationalUnit) > 0 {
+				header.OU = leaf.Subject.OrganizationalUnit[0]
+			}
+		}
+	}
+
+	return proxyproto.Write(backend, proxyproto.Version(*proxyProtocol), header)
+}
+
+// sigtermHandler waits for SIGTERM, stops accepting new connections, and
+// gives in-flight connections up to timeout to finish naturally before
+// force-closing whatever is left.
+func sigtermHandler(listener net.Listener, stopper chan bool, conns *connTracker, timeout time.Duration) {
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	<-sigterm
+
+	logger.Printf("received SIGTERM, closing listener and draining %d connection(s)", conns.count())
+	stopper <- true
+	listener.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		for conns.count() > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		logger.Printf("all connections drained gracefully")
+	case <-time.After(timeout):
+		logger.Printf("hammer time: %d connection(s) still open after %s, forcing closed", conns.count(), timeout)
+		conns.closeAll()
+	}
+}
+
+// aclReloadHandler waits for SIGHUP and reloads the ACL policy file,
+// independently of the full SO_REUSEPORT reexec used for certificate
+// reloads, so a policy-only change doesn't require spawning a new
+// worker process.
+func aclReloadHandler(store *acl.Store) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		if err := store.Reload(); err != nil {
+			logger.Printf("error reloading ACL policy: %s", err)
+			continue
+		}
+		metrics.ReloadEvents.Inc()
+		logger.Printf("reloaded ACL policy from %s", *aclFile)
+	}
+}
+
+// sigusr1Handler waits for SIGUSR1 and logs basic status information,
+// including the current drain progress, so operators can probe process
+// health.
+func sigusr1Handler(conns *connTracker) {
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+	for range sigusr1 {
+		logger.Printf("status: pid=%d, open connections=%d", os.Getpid(), conns.count())
+	}
+}
@@ -0,0 +1,370 @@
+// Package supervisor implements ghostunnel's wrapper mode: a long-lived
+// process that owns the listening socket's lifecycle, launches worker
+// subprocesses, and performs health-gated cutover on reload.
+//
+// Unlike the plain SO_REUSEPORT reload (where the old process simply
+// trusts that a new process sending SIGTERM means "I'm up"), the
+// supervisor keeps the previous worker alive until the new one has
+// demonstrated it can actually Accept() on the shared socket. If the new
+// worker dies within the grace window instead, the supervisor kills it and
+// keeps the previous worker serving rather than leaving the environment
+// with no listener at all.
+//
+// The supervisor itself opens the listening socket once and hands the
+// same fd down to every worker it spawns via ExtraFiles, rather than
+// having each worker bind its own SO_REUSEPORT socket -- this also means
+// readiness can't be signalled with SIGTERM (the worker's own shutdown
+// signal), so a dedicated pipe fd is used instead; see spawn.
+package supervisor
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/square/ghostunnel/metrics"
+)
+
+// wrapperOnlyFlags are flags meaningful only to the supervisor process
+// itself. They must never be forwarded to a spawned worker -- otherwise
+// the worker would re-enter wrapper mode and spawn a supervisor of its
+// own, which would spawn another, and so on. The value records whether
+// the flag takes a separate value argument (true) or is a bare boolean
+// (false) -- only the former needs its following token skipped too.
+var wrapperOnlyFlags = map[string]bool{
+	"--wrapper":           false,
+	"--pid-file":          true,
+	"--management-socket": true,
+}
+
+// childReadyFD and childListenFD are the file descriptor numbers a
+// spawned worker sees for, respectively, the readiness pipe and the
+// inherited listening socket. These follow deterministically from
+// spawn's fixed two-element cmd.ExtraFiles order (ExtraFiles[0] always
+// becomes fd 3, the first fd after stdin/stdout/stderr; ExtraFiles[1]
+// becomes fd 4). server.go's gracefulReadyFD constant must stay in sync
+// with childReadyFD; childListenFD reaches the worker via --listen-fd.
+const (
+	childReadyFD  = 3
+	childListenFD = 4
+)
+
+// workerArgs filters the supervisor's own argv down to the flags that
+// should be forwarded to a spawned worker, and adds --graceful plus
+// --listen-fd so the worker signals readiness over the inherited pipe
+// and accepts on the inherited listening socket instead of binding its
+// own (see spawn and server.go's gracefulChild/newListener handling).
+func workerArgs(raw []string) []string {
+	filtered := make([]string, 0, len(raw)+2)
+	skipNext := false
+	for _, arg := range raw {
+		if skipNext {
+			skipNext = false
+			continue
+		}
+
+		name := arg
+		if eq := strings.IndexByte(arg, '='); eq != -1 {
+			name = arg[:eq]
+		}
+
+		if takesValue, ok := wrapperOnlyFlags[name]; ok {
+			if takesValue && !strings.Contains(arg, "=") {
+				skipNext = true
+			}
+			continue
+		}
+
+		filtered = append(filtered, arg)
+	}
+	return append(filtered, "--graceful", fmt.Sprintf("--listen-fd=%d", childListenFD))
+}
+
+// Logger is the minimal logging surface the supervisor needs; satisfied
+// by ghostunnel's logging.Logger as well as a plain *log.Logger.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// graceWindow is how long a newly spawned worker has to prove it is
+// accepting connections before the supervisor gives up and rolls back.
+const graceWindow = 5 * time.Second
+
+// Config describes how a Supervisor should launch and monitor workers.
+type Config struct {
+	// Args are the command-line arguments used to re-exec the worker
+	// binary (i.e. os.Args[1:]). wrapperOnlyFlags are stripped out of
+	// these by workerArgs before each spawn.
+	Args []string
+
+	// PidFile, if set, is where the supervisor writes its own PID.
+	PidFile string
+
+	// ManagementSocket, if set, is a UNIX socket path that accepts one
+	// newline-terminated command per connection: "reload", "status",
+	// "drain".
+	ManagementSocket string
+
+	// ListenNetwork/ListenAddress identify the socket the supervisor
+	// opens once and hands down to every worker it spawns.
+	ListenNetwork string
+	ListenAddress string
+
+	Logger Logger
+}
+
+// worker tracks a single spawned child process.
+type worker struct {
+	cmd     *exec.Cmd
+	ready   chan bool
+	started time.Time
+}
+
+// Supervisor owns the current worker and coordinates reloads.
+type Supervisor struct {
+	config Config
+	self   string
+
+	// listener is the fd handed down to every worker via ExtraFiles, kept
+	// open for the lifetime of the supervisor so it survives reloads.
+	listener *os.File
+
+	mu      sync.Mutex
+	current *worker
+
+	// reloading serializes reload() across SIGHUP and management-socket
+	// "reload" commands, so two overlapping reloads can't each spawn a
+	// worker against the same previous snapshot and leak the loser.
+	reloading sync.Mutex
+}
+
+// New creates a Supervisor for the given configuration. It does not
+// launch anything until Run is called.
+func New(config Config) (*Supervisor, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("supervisor: unable to determine own executable: %s", err)
+	}
+
+	return &Supervisor{config: config, self: self}, nil
+}
+
+// Run writes the PID file, launches the initial worker, starts the
+// management listener (if configured), and blocks until the supervisor
+// is asked to exit.
+func (s *Supervisor) Run() error {
+	if s.config.PidFile != "" {
+		if err := os.WriteFile(s.config.PidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+			return fmt.Errorf("supervisor: unable to write pid file: %s", err)
+		}
+		defer os.Remove(s.config.PidFile)
+	}
+
+	ln, err := net.Listen(s.config.ListenNetwork, s.config.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("supervisor: unable to open listener: %s", err)
+	}
+	s.listener, err = fileFromListener(ln)
+	ln.Close() // the fd handed to workers keeps the socket alive
+	if err != nil {
+		return err
+	}
+	defer s.listener.Close()
+
+	w, err := s.spawn()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.current = w
+	s.mu.Unlock()
+
+	if s.config.ManagementSocket != "" {
+		go s.serveManagement()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+
+	for {
+		select {
+		case <-hup:
+			s.config.Logger.Printf("supervisor: reload requested via SIGHUP")
+			if err := s.reload(); err != nil {
+				s.config.Logger.Printf("supervisor: reload failed, keeping current worker: %s", err)
+			}
+		case <-term:
+			s.config.Logger.Printf("supervisor: shutting down")
+			s.mu.Lock()
+			if s.current != nil {
+				s.current.cmd.Process.Signal(syscall.SIGTERM)
+				s.current.cmd.Wait()
+			}
+			s.mu.Unlock()
+			return nil
+		}
+	}
+}
+
+// fileFromListener returns an *os.File wrapping ln's underlying fd, for
+// handoff to a spawned worker via ExtraFiles.
+func fileFromListener(ln net.Listener) (*os.File, error) {
+	switch t := ln.(type) {
+	case *net.TCPListener:
+		return t.File()
+	case *net.UnixListener:
+		return t.File()
+	default:
+		return nil, fmt.Errorf("supervisor: unsupported listener type %T for FD inheritance", ln)
+	}
+}
+
+// spawn launches a new worker, handing down the shared listening socket
+// (childListenFD) so it can accept on it directly instead of binding its
+// own. Readiness is signalled back over a dedicated pipe (childReadyFD)
+// rather than SIGTERM -- a worker's own shutdown handling, and the
+// supervisor's, both already listen for SIGTERM, so reusing it for
+// readiness would be indistinguishable from an external shutdown request
+// and would tear the supervisor down right after a successful spawn.
+func (s *Supervisor) spawn() (*worker, error) {
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("supervisor: unable to create readiness pipe: %s", err)
+	}
+
+	cmd := exec.Command(s.self, workerArgs(s.config.Args)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{readyW, s.listener}
+
+	w := &worker{cmd: cmd, ready: make(chan bool, 1), started: time.Now()}
+
+	if err := cmd.Start(); err != nil {
+		readyR.Close()
+		readyW.Close()
+		return nil, fmt.Errorf("supervisor: unable to start worker: %s", err)
+	}
+	// Our copy of the write end must be closed so that, if the worker
+	// dies without ever writing to it, the read below observes EOF
+	// instead of blocking for the full grace window.
+	readyW.Close()
+
+	go func() {
+		read := make(chan bool, 1)
+		go func() {
+			buf := make([]byte, 1)
+			n, _ := readyR.Read(buf)
+			read <- n > 0
+		}()
+
+		select {
+		case ok := <-read:
+			w.ready <- ok
+		case <-time.After(graceWindow):
+			w.ready <- false
+		}
+		readyR.Close()
+	}()
+
+	return w, nil
+}
+
+// reload spawns a new worker and only cuts over to it once it has
+// signalled readiness within the grace window; otherwise the previous
+// worker is left running untouched. Only one reload runs at a time --
+// a SIGHUP arriving mid-reload (or a concurrent management-socket
+// "reload" command) blocks here until the in-flight one finishes,
+// rather than racing it and leaking an untracked worker.
+func (s *Supervisor) reload() error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	s.mu.Lock()
+	previous := s.current
+	s.mu.Unlock()
+
+	next, err := s.spawn()
+	if err != nil {
+		return err
+	}
+
+	if ok := <-next.ready; !ok {
+		next.cmd.Process.Kill()
+		return fmt.Errorf("new worker did not become ready within %s, rolled back to pid %d", graceWindow, previous.cmd.Process.Pid)
+	}
+
+	s.mu.Lock()
+	s.current = next
+	s.mu.Unlock()
+
+	if previous != nil {
+		previous.cmd.Process.Signal(syscall.SIGTERM)
+		previous.cmd.Wait()
+	}
+
+	metrics.ReloadEvents.Inc()
+	return nil
+}
+
+// serveManagement accepts connections on the management UNIX socket and
+// handles "reload", "status" and "drain" commands.
+func (s *Supervisor) serveManagement() {
+	os.Remove(s.config.ManagementSocket)
+	ln, err := net.Listen("unix", s.config.ManagementSocket)
+	if err != nil {
+		s.config.Logger.Printf("supervisor: unable to open management socket: %s", err)
+		return
+	}
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleManagementConn(conn)
+	}
+}
+
+func (s *Supervisor) handleManagementConn(conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+
+	switch string(buf[:n]) {
+	case "reload\n":
+		if err := s.reload(); err != nil {
+			fmt.Fprintf(conn, "error: %s\n", err)
+			return
+		}
+		fmt.Fprintf(conn, "ok\n")
+	case "status\n":
+		s.mu.Lock()
+		pid := s.current.cmd.Process.Pid
+		s.mu.Unlock()
+		fmt.Fprintf(conn, "worker pid=%d\n", pid)
+	case "drain\n":
+		s.mu.Lock()
+		current := s.current
+		s.mu.Unlock()
+		if current != nil {
+			current.cmd.Process.Signal(syscall.SIGTERM)
+		}
+		fmt.Fprintf(conn, "ok\n")
+	default:
+		fmt.Fprintf(conn, "unknown command\n")
+	}
+}
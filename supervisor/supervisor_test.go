@@ -0,0 +1,165 @@
+package supervisor
+
+import (
+	"flag"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var gracefulSuffix = []string{"--graceful", "--listen-fd=4"}
+
+func TestWorkerArgsStripsWrapperOnlyFlags(t *testing.T) {
+	raw := []string{"--listen", ":8443", "--wrapper", "--pid-file", "/var/run/x.pid", "--management-socket", "/var/run/x.sock"}
+	got := workerArgs(raw)
+	want := append([]string{"--listen", ":8443"}, gracefulSuffix...)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("workerArgs(%v) = %v, want %v", raw, got, want)
+	}
+}
+
+func TestWorkerArgsBareWrapperDoesNotEatNextFlag(t *testing.T) {
+	raw := []string{"--listen", ":8443", "--wrapper", "--pid-file", "/var/run/x.pid"}
+	got := workerArgs(raw)
+	want := append([]string{"--listen", ":8443"}, gracefulSuffix...)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("workerArgs(%v) = %v, want %v -- --pid-file must be dropped with its value, not leave the value behind as a positional arg", raw, got, want)
+	}
+}
+
+func TestWorkerArgsHandlesEqualsForm(t *testing.T) {
+	raw := []string{"--listen", ":8443", "--pid-file=/var/run/x.pid", "--management-socket=/var/run/x.sock"}
+	got := workerArgs(raw)
+	want := append([]string{"--listen", ":8443"}, gracefulSuffix...)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("workerArgs(%v) = %v, want %v", raw, got, want)
+	}
+}
+
+func TestWorkerArgsPreservesOrdinaryFlags(t *testing.T) {
+	raw := []string{"--listen", ":8443", "--target", "127.0.0.1:9000", "--client", "engineering"}
+	got := workerArgs(raw)
+	want := append(append([]string{}, raw...), gracefulSuffix...)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("workerArgs(%v) = %v, want %v", raw, got, want)
+	}
+}
+
+// TestHelperProcess is not a real test; it's a worker stand-in re-exec'd
+// by the tests below via os.Args[0], following the pattern used by the
+// standard library's os/exec tests. It reads its own mode off argv
+// (everything after "--") and behaves accordingly.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GHOSTUNNEL_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return
+	}
+
+	switch args[0] {
+	case "ready":
+		f := os.NewFile(childReadyFD, "ready")
+		f.Write([]byte{1})
+		f.Close()
+	case "silent":
+		time.Sleep(time.Hour)
+	}
+}
+
+// helperSupervisor returns a Supervisor configured to re-exec this test
+// binary as its "worker", with mode passed via Config.Args so it reaches
+// TestHelperProcess as a positional argument after "--".
+func helperSupervisor(mode string) *Supervisor {
+	return &Supervisor{
+		self: os.Args[0],
+		config: Config{
+			Args: []string{"-test.run=TestHelperProcess", "--", mode},
+		},
+		listener: testListenerFileForPackage,
+	}
+}
+
+var testListenerFileForPackage *os.File
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	if os.Getenv("GHOSTUNNEL_WANT_HELPER_PROCESS") == "1" {
+		// -test.run=TestHelperProcess (set by helperSupervisor via
+		// Config.Args) restricts m.Run() to just that test, so this
+		// doesn't recursively re-exec the whole suite.
+		os.Exit(m.Run())
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.Exit(1)
+	}
+	f, err := fileFromListener(ln)
+	ln.Close()
+	if err != nil {
+		os.Exit(1)
+	}
+	testListenerFileForPackage = f
+
+	os.Exit(m.Run())
+}
+
+func TestSpawnSignalsReadyOverPipeNotSIGTERM(t *testing.T) {
+	os.Setenv("GHOSTUNNEL_WANT_HELPER_PROCESS", "1")
+	defer os.Unsetenv("GHOSTUNNEL_WANT_HELPER_PROCESS")
+
+	s := helperSupervisor("ready")
+	w, err := s.spawn()
+	if err != nil {
+		t.Fatalf("spawn: %s", err)
+	}
+	defer w.cmd.Process.Kill()
+
+	select {
+	case ok := <-w.ready:
+		if !ok {
+			t.Error("expected worker to report ready, got false")
+		}
+	case <-time.After(graceWindow + time.Second):
+		t.Fatal("timed out waiting for readiness")
+	}
+}
+
+func TestSpawnReportsNotReadyWhenWorkerNeverSignalsReady(t *testing.T) {
+	os.Setenv("GHOSTUNNEL_WANT_HELPER_PROCESS", "1")
+	defer os.Unsetenv("GHOSTUNNEL_WANT_HELPER_PROCESS")
+
+	s := helperSupervisor("silent")
+	w, err := s.spawn()
+	if err != nil {
+		t.Fatalf("spawn: %s", err)
+	}
+	defer w.cmd.Process.Kill()
+
+	select {
+	case ok := <-w.ready:
+		if ok {
+			t.Error("expected worker that never signals readiness to report not-ready")
+		}
+	case <-time.After(graceWindow + time.Second):
+		t.Fatal("timed out waiting for spawn's own grace window to elapse")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// loadCABundle reads and parses a PEM-encoded CA bundle file into a pool.
+func loadCABundle(path string) *x509.CertPool {
+	bundleBytes, err := ioutil.ReadFile(path)
+	panicOnError(err)
+
+	bundle := x509.NewCertPool()
+	if ok := bundle.AppendCertsFromPEM(bundleBytes); !ok {
+		panic("unable to parse CA bundle")
+	}
+	return bundle
+}
+
+// buildServerConfig constructs the server-side TLS configuration used
+// when terminating mTLS connections, including client certificate
+// verification against the ACL policy (or, absent one, the allowed OU
+// list from --client).
+func buildServerConfig() *tls.Config {
+	certificate, err := tls.LoadX509KeyPair(*certChainPath, *privateKeyPath)
+	panicOnError(err)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    loadCABundle(*caBundlePath),
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(verifiedChains) == 0 {
+				return fmt.Errorf("no verified client certificate chain")
+			}
+			leaf := verifiedChains[0][0]
+
+			if aclStore != nil {
+				return aclStore.Verify(leaf)
+			}
+
+			for _, ou := range leaf.Subject.OrganizationalUnit {
+				for _, allowed := range *clientNames {
+					if ou == allowed {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("client certificate OU does not match any of %s", strings.Join(*clientNames, ", "))
+		},
+	}
+}
+
+// buildClientConfig constructs the client-side TLS configuration used in
+// reverse mode when dialing out to a remote server: it presents our
+// configured client certificate and validates the remote server's
+// certificate against --cacert, plus an expected CN from --verify-cn.
+func buildClientConfig() *tls.Config {
+	certificate, err := tls.LoadX509KeyPair(*certChainPath, *privateKeyPath)
+	panicOnError(err)
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      loadCABundle(*caBundlePath),
+		ServerName:   *serverName,
+	}
+
+	if *verifyCN != "" {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, len(rawCerts))
+			for i, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("unable to parse server certificate: %s", err)
+				}
+				certs[i] = cert
+			}
+
+			opts := x509.VerifyOptions{Roots: config.RootCAs, Intermediates: x509.NewCertPool()}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			if _, err := certs[0].Verify(opts); err != nil {
+				return fmt.Errorf("unable to verify server certificate chain: %s", err)
+			}
+
+			if certs[0].Subject.CommonName != *verifyCN {
+				return fmt.Errorf("server certificate CN %q does not match expected %q", certs[0].Subject.CommonName, *verifyCN)
+			}
+			return nil
+		}
+	}
+
+	return config
+}